@@ -0,0 +1,231 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package buildinfo embeds a reproducible record of how a Caddy binary was
+// built into the binary itself, and decodes that record back out of any
+// Caddy binary (including ones built by an older copy of this tool).
+package buildinfo
+
+import (
+	"crypto/sha256"
+	"debug/buildinfo"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// pkgPath is the import path under which the -X variables below live; it
+// must match the package path baked into the -ldflags produced by LDFlags.
+const pkgPath = "github.com/caddyserver/xcaddy/buildinfo"
+
+// caddyModulePath is Caddy core's module path, as it appears among a
+// built binary's dependencies rather than as its main module (the main
+// module of a binary built by xcaddy is its own generated build-environment
+// module, which *requires* Caddy, so it must be found among the deps).
+const caddyModulePath = "github.com/caddyserver/caddy/v2"
+
+// These are populated at build time via -ldflags -X, and read back out of
+// a binary by Decode. They are not meant to be set any other way.
+var (
+	CaddyVersion string
+	GoVersion    string
+	MainHash     string
+	PluginsJSON  string
+)
+
+// Plugin describes a single plugin module that was compiled into a Caddy
+// binary, as recorded by the builder that produced it.
+type Plugin struct {
+	ModulePath string `json:"module"`
+	Version    string `json:"version,omitempty"`
+	Replace    string `json:"replace,omitempty"`
+}
+
+// Info is the machine-readable manifest describing how a Caddy binary was
+// built: the exact plugin set, the Caddy core version, the Go toolchain
+// used, and a content hash of the Caddy version and plugin set (the Go
+// toolchain version is not part of the hash).
+type Info struct {
+	CaddyVersion string   `json:"caddy_version"`
+	GoVersion    string   `json:"go_version"`
+	MainHash     string   `json:"main_hash"`
+	Plugins      []Plugin `json:"plugins,omitempty"`
+}
+
+// Hash computes the content hash used to fingerprint a build: a SHA-256
+// digest of the build's canonical JSON representation (Caddy version plus
+// the sorted plugin list), so the same inputs always hash the same way.
+func Hash(caddyVersion string, plugins []Plugin) (string, error) {
+	sorted := append([]Plugin(nil), plugins...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].ModulePath < sorted[j].ModulePath
+	})
+	canon, err := json.Marshal(struct {
+		CaddyVersion string   `json:"caddy_version"`
+		Plugins      []Plugin `json:"plugins"`
+	}{caddyVersion, sorted})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canon)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// LDFlags renders info as a single -ldflags value that sets this package's
+// build-time variables, suitable for XCADDY_GO_BUILD_FLAGS or a direct
+// `go build -ldflags` invocation.
+func LDFlags(info Info) (string, error) {
+	pluginsJSON, err := json.Marshal(info.Plugins)
+	if err != nil {
+		return "", err
+	}
+
+	set := func(name, value string) string {
+		return fmt.Sprintf("-X '%s.%s=%s'", pkgPath, name, strings.ReplaceAll(value, "'", `'"'"'`))
+	}
+
+	return strings.Join([]string{
+		set("CaddyVersion", info.CaddyVersion),
+		set("GoVersion", info.GoVersion),
+		set("MainHash", info.MainHash),
+		set("PluginsJSON", string(pluginsJSON)),
+	}, " "), nil
+}
+
+// Self returns the Info embedded in the currently-running binary, as set
+// by -ldflags at build time. It is zero-valued when the running binary
+// wasn't built with those flags (e.g. `go run` or `go test`).
+func Self() Info {
+	var plugins []Plugin
+	if PluginsJSON != "" {
+		_ = json.Unmarshal([]byte(PluginsJSON), &plugins)
+	}
+	return Info{
+		CaddyVersion: CaddyVersion,
+		GoVersion:    GoVersion,
+		MainHash:     MainHash,
+		Plugins:      plugins,
+	}
+}
+
+// Decode reads the build manifest out of the Caddy binary at path. It
+// prefers the -ldflags -X variables embedded by this package, recovered
+// from the "-ldflags" build setting Go itself records in every binary;
+// if those are absent (e.g. a binary built by a version of xcaddy that
+// predates this package), it falls back to Go's own module build info.
+func Decode(path string) (Info, error) {
+	bi, err := buildinfo.ReadFile(path)
+	if err != nil {
+		return Info{}, fmt.Errorf("reading build info from %s: %w", path, err)
+	}
+
+	info := Info{GoVersion: bi.GoVersion}
+
+	var ldflags string
+	for _, s := range bi.Settings {
+		if s.Key == "-ldflags" {
+			ldflags = s.Value
+			break
+		}
+	}
+	if ldflags != "" {
+		applyLDFlags(&info, ldflags)
+	}
+
+	if info.CaddyVersion == "" {
+		for _, dep := range bi.Deps {
+			if dep.Path == caddyModulePath {
+				info.CaddyVersion = dep.Version
+				break
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// applyLDFlags extracts this package's -X variables out of a raw -ldflags
+// string and merges them into info. splitLDFlagAssignments already strips
+// the "-X" flag and the surrounding quotes, so each token here is a bare
+// "pkg.Var=value" assignment.
+func applyLDFlags(info *Info, ldflags string) {
+	prefix := pkgPath + "."
+
+	for _, tok := range splitLDFlagAssignments(ldflags) {
+		if !strings.HasPrefix(tok, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(tok, prefix)
+
+		name, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			continue
+		}
+		value = strings.ReplaceAll(value, `'"'"'`, "'")
+
+		switch name {
+		case "CaddyVersion":
+			info.CaddyVersion = value
+		case "GoVersion":
+			info.GoVersion = value
+		case "MainHash":
+			info.MainHash = value
+		case "PluginsJSON":
+			_ = json.Unmarshal([]byte(value), &info.Plugins)
+		}
+	}
+}
+
+// splitLDFlagAssignments splits a raw -ldflags string into its individual
+// "pkg.Var=value" assignments, stripping each "-X" flag and the
+// surrounding quotes, and honoring single-quoted values that may
+// themselves contain spaces.
+func splitLDFlagAssignments(ldflags string) []string {
+	var tokens []string
+	var cur strings.Builder
+	inQuote := false
+
+	flush := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+
+	for i := 0; i < len(ldflags); i++ {
+		c := ldflags[i]
+		switch {
+		case c == '\'':
+			// toggle quoting, but don't keep the quote character itself
+			inQuote = !inQuote
+		case c == ' ' && !inQuote:
+			flush()
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	flush()
+
+	// drop the bare "-X" flag tokens; what's left is just the assignments
+	var assignments []string
+	for _, tok := range tokens {
+		if tok == "-X" {
+			continue
+		}
+		assignments = append(assignments, tok)
+	}
+	return assignments
+}
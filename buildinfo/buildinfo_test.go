@@ -0,0 +1,163 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package buildinfo
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// TestLDFlagsDecodeRoundTrip builds a real binary with the -ldflags that
+// LDFlags produces, then runs Decode against that binary, to make sure the
+// two halves of the embed/extract round trip actually agree on the wire
+// format (in-memory struct round trips alone don't catch a mismatch
+// between how -X assignments are written and how they're parsed back out
+// of `go version -m`/debug/buildinfo's "-ldflags" setting).
+func TestLDFlagsDecodeRoundTrip(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not available")
+	}
+
+	_, thisFile, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Fatal("could not determine this package's source directory")
+	}
+	src, err := os.ReadFile(filepath.Join(filepath.Dir(thisFile), "buildinfo.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Info{
+		CaddyVersion: "v2.7.6",
+		GoVersion:    "go1.21.0",
+		MainHash:     "deadbeefcafe",
+		Plugins: []Plugin{
+			{ModulePath: "github.com/example/plugin", Version: "v1.2.3"},
+			{ModulePath: "github.com/example/other", Version: "v0.0.0", Replace: "../other"},
+		},
+	}
+
+	ldflags, err := LDFlags(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "go.mod"), []byte(
+		"module github.com/caddyserver/xcaddy\n\ngo 1.20\n",
+	), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(tmp, "buildinfo"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "buildinfo", "buildinfo.go"), src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "main.go"), []byte(
+		"package main\n\nimport \"github.com/caddyserver/xcaddy/buildinfo\"\n\nfunc main() { _ = buildinfo.Self() }\n",
+	), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	binPath := filepath.Join(tmp, "testbin")
+	cmd := exec.Command("go", "build", "-ldflags", ldflags, "-o", binPath, ".")
+	cmd.Dir = tmp
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("building helper binary: %v\n%s", err, out)
+	}
+
+	got, err := Decode(binPath)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	if got.CaddyVersion != want.CaddyVersion {
+		t.Errorf("CaddyVersion: got %q, want %q", got.CaddyVersion, want.CaddyVersion)
+	}
+	if got.GoVersion != want.GoVersion {
+		t.Errorf("GoVersion: got %q, want %q", got.GoVersion, want.GoVersion)
+	}
+	if got.MainHash != want.MainHash {
+		t.Errorf("MainHash: got %q, want %q", got.MainHash, want.MainHash)
+	}
+	if !reflect.DeepEqual(got.Plugins, want.Plugins) {
+		t.Errorf("Plugins: got %#v, want %#v", got.Plugins, want.Plugins)
+	}
+}
+
+// TestDecodeFallbackUsesCaddyDepVersion builds a binary with no -ldflags at
+// all (standing in for one built by a version of xcaddy that predates this
+// package) that depends on a stand-in Caddy core module, and asserts Decode
+// recovers the Caddy version from that dependency's line in the binary's
+// module graph rather than from the binary's own main module, which for any
+// real xcaddy-built binary is just its generated build-environment module.
+func TestDecodeFallbackUsesCaddyDepVersion(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not available")
+	}
+
+	tmp := t.TempDir()
+	caddyStub := filepath.Join(tmp, "caddystub")
+	if err := os.Mkdir(caddyStub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(caddyStub, "go.mod"), []byte(
+		"module github.com/caddyserver/caddy/v2\n\ngo 1.20\n",
+	), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(caddyStub, "caddy.go"), []byte(
+		"package caddy\n\nfunc Marker() {}\n",
+	), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buildEnv := filepath.Join(tmp, "xcaddy-build-env")
+	if err := os.Mkdir(buildEnv, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(buildEnv, "go.mod"), []byte(
+		"module xcaddy-build-env\n\ngo 1.20\n\nrequire github.com/caddyserver/caddy/v2 v2.7.6\n\nreplace github.com/caddyserver/caddy/v2 => ../caddystub\n",
+	), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(buildEnv, "main.go"), []byte(
+		"package main\n\nimport \"github.com/caddyserver/caddy/v2\"\n\nfunc main() { caddy.Marker() }\n",
+	), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	binPath := filepath.Join(tmp, "testbin")
+	cmd := exec.Command("go", "build", "-o", binPath, ".")
+	cmd.Dir = buildEnv
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("building helper binary: %v\n%s", err, out)
+	}
+
+	got, err := Decode(binPath)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if got.CaddyVersion != "v2.7.6" {
+		t.Errorf("CaddyVersion: got %q, want %q", got.CaddyVersion, "v2.7.6")
+	}
+}
@@ -16,6 +16,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
@@ -24,25 +25,69 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/xcaddy"
+	"github.com/caddyserver/xcaddy/buildinfo"
+	"github.com/caddyserver/xcaddy/manifest"
 )
 
 var caddyVersion = os.Getenv("CADDY_VERSION")
 
+// shutdownGracePeriod is how long a child process (e.g. the `caddy` spawned
+// by `xcaddy run`/dev mode) is given to exit after SIGINT before we escalate
+// to SIGKILL.
+const shutdownGracePeriod = 10 * time.Second
+
+// caddyModulePath is Caddy's own module path, used to pick Caddy's core
+// version out of a binary's dependency list rather than its main module
+// (which, for a binary built by this tool, is xcaddy's own generated
+// build-environment module).
+const caddyModulePath = "github.com/caddyserver/caddy/v2"
+
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	go trapSignals(ctx, cancel)
+	interrupted := trapSignals(ctx, cancel)
+
+	// Give this invocation its own temp directory, and point the builder at
+	// it via the env vars os.TempDir() consults, so that its "buildenv_*"
+	// scratch directories land somewhere only this invocation writes to. A
+	// global os.TempDir() sweep would otherwise risk deleting another,
+	// still-in-progress xcaddy invocation's scratch directory out from
+	// under it (e.g. two overlapping builds on the same CI host).
+	buildEnvTempDir, err := os.MkdirTemp("", fmt.Sprintf("xcaddy_%d_", os.Getpid()))
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	defer os.RemoveAll(buildEnvTempDir)
+	os.Setenv("TMPDIR", buildEnvTempDir) // unix
+	os.Setenv("TMP", buildEnvTempDir)    // windows
+	os.Setenv("TEMP", buildEnvTempDir)   // windows
+
+	switch {
+	case len(os.Args) > 1 && os.Args[1] == "build":
+		err = runBuild(ctx, os.Args[2:])
+	case len(os.Args) > 1 && os.Args[1] == "add-package":
+		err = runAddPackage(ctx, os.Args[2:])
+	case len(os.Args) > 1 && os.Args[1] == "remove-package":
+		err = runRemovePackage(ctx, os.Args[2:])
+	case len(os.Args) > 1 && os.Args[1] == "build-info":
+		err = runBuildInfo(os.Args[2:])
+	default:
+		err = runDev(ctx, os.Args[1:])
+	}
 
-	if len(os.Args) > 1 && os.Args[1] == "build" {
-		if err := runBuild(ctx, os.Args[2:]); err != nil {
-			log.Fatalf("[ERROR] %v", err)
-		}
-		return
+	// if we got here because of a SIGINT, the build (if any) was cut
+	// short; sweep up any scratch directory xcaddy's builder left behind
+	// in this invocation's own temp directory
+	select {
+	case <-interrupted:
+		sweepBuildEnvTempDirs(buildEnvTempDir)
+	default:
 	}
 
-	if err := runDev(ctx, os.Args[1:]); err != nil {
+	if err != nil {
 		log.Fatalf("[ERROR] %v", err)
 	}
 }
@@ -50,11 +95,18 @@ func main() {
 func runBuild(ctx context.Context, args []string) error {
 	// parse the command line args... rather primitively
 	var cgoAllowed bool
-	var argCaddyVersion, output string
+	var argCaddyVersion, output, configPath string
 	var plugins []xcaddy.Dependency
 	var replacements []xcaddy.Replace
 	for i := 0; i < len(args); i++ {
 		switch args[i] {
+		case "--config":
+			if i == len(args)-1 {
+				return fmt.Errorf("expected value after --config flag")
+			}
+			i++
+			configPath = args[i]
+
 		case "--with":
 			if i == len(args)-1 {
 				return fmt.Errorf("expected value after --with flag")
@@ -93,6 +145,13 @@ func runBuild(ctx context.Context, args []string) error {
 		}
 	}
 
+	// a manifest takes over the entire build: it declares its own Caddy
+	// version, plugin set, and possibly a whole matrix of targets, so it
+	// doesn't mix with --with/--output/--enable-cgo
+	if configPath != "" {
+		return runManifestBuild(ctx, configPath)
+	}
+
 	// prefer caddy version from command line argument over env var
 	if argCaddyVersion != "" {
 		caddyVersion = argCaddyVersion
@@ -111,6 +170,13 @@ func runBuild(ctx context.Context, args []string) error {
 		output = "CGO_ENABLED=1 " + output
 	}
 
+	// embed reproducible build metadata (plugin list, versions, replace
+	// directives, Go toolchain, and a content hash of the build inputs)
+	// into the binary so `xcaddy build-info` can recover it later
+	if err := embedBuildInfo(caddyVersion, plugins, replacements); err != nil {
+		return fmt.Errorf("embedding build info: %v", err)
+	}
+
 	// perform the build
 	builder := xcaddy.Builder{
 		CaddyVersion: caddyVersion,
@@ -139,6 +205,415 @@ func runBuild(ctx context.Context, args []string) error {
 	return nil
 }
 
+// runManifestBuild drives a declarative build from a --config manifest:
+// for each target in the matrix (or the current GOOS/GOARCH if the
+// manifest declares none), it sets up the cross-compilation environment
+// and invokes xcaddy.Builder.Build once, producing one binary per target.
+func runManifestBuild(ctx context.Context, configPath string) error {
+	m, err := manifest.Load(configPath)
+	if err != nil {
+		return err
+	}
+
+	var plugins []xcaddy.Dependency
+	var replacements []xcaddy.Replace
+	for _, p := range m.Plugins {
+		plugins = append(plugins, xcaddy.Dependency{
+			ModulePath: p.Module,
+			Version:    p.Version,
+		})
+		if p.Replace != "" {
+			replacements = append(replacements, xcaddy.Replace{
+				Old: p.Module,
+				New: p.Replace,
+			})
+		}
+	}
+
+	buildFlags := strings.TrimSpace(os.Getenv("XCADDY_GO_BUILD_FLAGS"))
+	if len(m.BuildTags) > 0 {
+		buildFlags = strings.TrimSpace(buildFlags + " -tags " + strings.Join(m.BuildTags, ","))
+	}
+	if len(m.LDFlags) > 0 {
+		buildFlags = strings.TrimSpace(buildFlags + " -ldflags=" + strings.Join(m.LDFlags, " "))
+	}
+
+	targets := m.TargetsOrDefault(runtime.GOOS, runtime.GOARCH, os.Getenv("GOARM"))
+	for _, t := range targets {
+		output, err := m.OutputName(t)
+		if err != nil {
+			return err
+		}
+
+		// reset to the manifest's own build flags first, so embedBuildInfo
+		// (which reads XCADDY_GO_BUILD_FLAGS and appends its own -ldflags)
+		// doesn't get immediately overwritten by this line, and doesn't
+		// keep compounding onto a prior target's flags either
+		if err := os.Setenv("XCADDY_GO_BUILD_FLAGS", buildFlags); err != nil {
+			return err
+		}
+		if err := embedBuildInfo(m.CaddyVersion, plugins, replacements); err != nil {
+			return fmt.Errorf("embedding build info: %v", err)
+		}
+		if err := os.Setenv("GOOS", t.OS); err != nil {
+			return err
+		}
+		if err := os.Setenv("GOARCH", t.Arch); err != nil {
+			return err
+		}
+		if t.Arm != "" {
+			if err := os.Setenv("GOARM", t.Arm); err != nil {
+				return err
+			}
+		}
+		if m.CGOEnabled {
+			if err := os.Setenv("CGO_ENABLED", "1"); err != nil {
+				return err
+			}
+		} else {
+			if err := os.Setenv("CGO_ENABLED", "0"); err != nil {
+				return err
+			}
+		}
+
+		log.Printf("[INFO] Building %s (%s/%s)", output, t.OS, t.Arch)
+
+		builder := xcaddy.Builder{
+			CaddyVersion: m.CaddyVersion,
+			Plugins:      plugins,
+			Replacements: replacements,
+		}
+		if err := builder.Build(ctx, output); err != nil {
+			return fmt.Errorf("building %s: %w", output, err)
+		}
+	}
+
+	return nil
+}
+
+// embedBuildInfo sets XCADDY_GO_BUILD_FLAGS so the `go build` invocation
+// inside xcaddy.Builder.Build embeds a buildinfo.Info manifest into the
+// resulting binary, without requiring any changes to xcaddy.Builder itself.
+func embedBuildInfo(caddyVer string, plugins []xcaddy.Dependency, replacements []xcaddy.Replace) error {
+	info := buildinfo.Info{
+		CaddyVersion: caddyVer,
+		GoVersion:    runtime.Version(),
+		Plugins:      toBuildInfoPlugins(plugins, replacements),
+	}
+
+	hash, err := buildinfo.Hash(info.CaddyVersion, info.Plugins)
+	if err != nil {
+		return err
+	}
+	info.MainHash = hash
+
+	ldflags, err := buildinfo.LDFlags(info)
+	if err != nil {
+		return err
+	}
+
+	extra := "-ldflags=" + ldflags
+	if existing := os.Getenv("XCADDY_GO_BUILD_FLAGS"); existing != "" {
+		extra = existing + " " + extra
+	}
+	return os.Setenv("XCADDY_GO_BUILD_FLAGS", extra)
+}
+
+// toBuildInfoPlugins converts the builder's own dependency/replace types
+// into the flattened form buildinfo.Info records.
+func toBuildInfoPlugins(plugins []xcaddy.Dependency, replacements []xcaddy.Replace) []buildinfo.Plugin {
+	replaceFor := make(map[string]string, len(replacements))
+	for _, r := range replacements {
+		replaceFor[r.Old] = r.New
+	}
+
+	out := make([]buildinfo.Plugin, 0, len(plugins))
+	for _, p := range plugins {
+		out = append(out, buildinfo.Plugin{
+			ModulePath: p.ModulePath,
+			Version:    p.Version,
+			Replace:    replaceFor[p.ModulePath],
+		})
+	}
+	return out
+}
+
+// runBuildInfo decodes and prints, as JSON, the build manifest embedded in
+// an existing Caddy binary.
+func runBuildInfo(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: xcaddy build-info <binary>")
+	}
+
+	info, err := buildinfo.Decode(args[0])
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
+}
+
+// runAddPackage rebuilds the Caddy binary at the given --binary path (or the
+// default caddy/caddy.exe in the current working directory) with the given modules merged
+// into its existing plugin set.
+func runAddPackage(ctx context.Context, args []string) error {
+	binary, modArgs, err := parsePackageArgs(args)
+	if err != nil {
+		return err
+	}
+
+	plugins, replacements, ver, err := currentPlugins(binary)
+	if err != nil {
+		return fmt.Errorf("reading current plugin set from %s: %v", binary, err)
+	}
+
+	for _, arg := range modArgs {
+		mod, modVer, repl, err := splitWith(arg)
+		if err != nil {
+			return err
+		}
+		plugins = upsertDependency(plugins, xcaddy.Dependency{
+			ModulePath: mod,
+			Version:    modVer,
+		})
+		if repl != "" {
+			replacements = upsertReplace(replacements, xcaddy.Replace{
+				Old: mod,
+				New: repl,
+			})
+		}
+	}
+
+	return rebuildInPlace(ctx, binary, ver, plugins, replacements)
+}
+
+// runRemovePackage rebuilds the Caddy binary at the given --binary path (or
+// the default caddy/caddy.exe in the current working directory) with the given modules
+// dropped from its existing plugin set.
+func runRemovePackage(ctx context.Context, args []string) error {
+	binary, modArgs, err := parsePackageArgs(args)
+	if err != nil {
+		return err
+	}
+
+	plugins, replacements, ver, err := currentPlugins(binary)
+	if err != nil {
+		return fmt.Errorf("reading current plugin set from %s: %v", binary, err)
+	}
+
+	for _, arg := range modArgs {
+		mod, _, _, err := splitWith(arg)
+		if err != nil {
+			return err
+		}
+		plugins = removeDependency(plugins, mod)
+		replacements = removeReplace(replacements, mod)
+	}
+
+	return rebuildInPlace(ctx, binary, ver, plugins, replacements)
+}
+
+// parsePackageArgs pulls the optional --binary flag out of args and returns
+// the remaining module[@version][=replace] arguments.
+func parsePackageArgs(args []string) (binary string, modArgs []string, err error) {
+	binary = defaultBinaryName()
+
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--binary" {
+			if i == len(args)-1 {
+				return "", nil, fmt.Errorf("expected value after --binary flag")
+			}
+			i++
+			binary = args[i]
+			continue
+		}
+		modArgs = append(modArgs, args[i])
+	}
+
+	if len(modArgs) == 0 {
+		return "", nil, fmt.Errorf("at least one module is required")
+	}
+
+	return binary, modArgs, nil
+}
+
+// defaultBinaryName returns the path to the Caddy binary this tool manages
+// when no --binary flag is given: caddy (or caddy.exe on Windows) in the
+// current working directory.
+func defaultBinaryName() string {
+	if runtime.GOOS == "windows" {
+		return "caddy.exe"
+	}
+	return "caddy"
+}
+
+// currentPlugins reads the plugin set embedded in an existing Caddy binary,
+// so that add-package/remove-package can merge changes into a binary's
+// existing build rather than starting from scratch. It prefers the
+// buildinfo manifest embedded by this tool's own `build` command, and
+// falls back to parsing `go version -m` for binaries built without it.
+func currentPlugins(binary string) (plugins []xcaddy.Dependency, replacements []xcaddy.Replace, caddyVer string, err error) {
+	// info.MainHash is set whenever embedBuildInfo actually ran, regardless
+	// of whether the manifest it embedded happens to list zero plugins;
+	// gating on len(info.Plugins) instead would treat "no plugins" the same
+	// as "no manifest embedded" and fall through to the go-version-m path
+	// below, which reports the build-env module's own dependencies as if
+	// they were plugins passed via --with.
+	if info, decodeErr := buildinfo.Decode(binary); decodeErr == nil && info.MainHash != "" {
+		for _, p := range info.Plugins {
+			plugins = append(plugins, xcaddy.Dependency{
+				ModulePath: p.ModulePath,
+				Version:    p.Version,
+			})
+			if p.Replace != "" {
+				replacements = append(replacements, xcaddy.Replace{
+					Old: p.ModulePath,
+					New: p.Replace,
+				})
+			}
+		}
+		return plugins, replacements, info.CaddyVersion, nil
+	}
+
+	cmd := exec.Command("go", "version", "-m", binary)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	plugins, replacements, caddyVer = parseGoVersionM(string(out))
+	return plugins, replacements, caddyVer, nil
+}
+
+// parseGoVersionM parses the output of `go version -m <binary>` into the
+// plugin set and Caddy core version it describes.
+//
+// NOTE: the "mod" line in that output describes the main module of the
+// inspected binary, which for a binary built by this tool is xcaddy's own
+// generated build-environment module (the one that *requires* Caddy), not
+// Caddy itself — so the Caddy version has to be found among the "dep"
+// lines instead, by module path.
+func parseGoVersionM(out string) (plugins []xcaddy.Dependency, replacements []xcaddy.Replace, caddyVer string) {
+	var lastDep string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "dep":
+			if len(fields) < 3 {
+				continue
+			}
+			lastDep = fields[1]
+			if fields[1] == caddyModulePath {
+				caddyVer = fields[2]
+				continue
+			}
+			plugins = append(plugins, xcaddy.Dependency{
+				ModulePath: fields[1],
+				Version:    fields[2],
+			})
+		case "=>":
+			if lastDep == "" || len(fields) < 2 {
+				continue
+			}
+			target := fields[1]
+			if len(fields) >= 3 && !isLocalPath(fields[1]) {
+				// a versioned (non-local-path) replace target: keep the
+				// version, or it's silently dropped from the rebuilt
+				// replace directive
+				target = fields[1] + " " + fields[2]
+			}
+			replacements = append(replacements, xcaddy.Replace{
+				Old: lastDep,
+				New: target,
+			})
+		}
+	}
+
+	return plugins, replacements, caddyVer
+}
+
+// upsertDependency adds dep to plugins, replacing any existing entry for
+// the same module path.
+func upsertDependency(plugins []xcaddy.Dependency, dep xcaddy.Dependency) []xcaddy.Dependency {
+	for i, p := range plugins {
+		if p.ModulePath == dep.ModulePath {
+			plugins[i] = dep
+			return plugins
+		}
+	}
+	return append(plugins, dep)
+}
+
+// removeDependency drops the entry for modulePath from plugins, if present.
+func removeDependency(plugins []xcaddy.Dependency, modulePath string) []xcaddy.Dependency {
+	for i, p := range plugins {
+		if p.ModulePath == modulePath {
+			return append(plugins[:i], plugins[i+1:]...)
+		}
+	}
+	return plugins
+}
+
+// upsertReplace adds rep to replacements, replacing any existing entry for
+// the same module path.
+func upsertReplace(replacements []xcaddy.Replace, rep xcaddy.Replace) []xcaddy.Replace {
+	for i, r := range replacements {
+		if r.Old == rep.Old {
+			replacements[i] = rep
+			return replacements
+		}
+	}
+	return append(replacements, rep)
+}
+
+// removeReplace drops the entry for modulePath from replacements, if present.
+func removeReplace(replacements []xcaddy.Replace, modulePath string) []xcaddy.Replace {
+	for i, r := range replacements {
+		if r.Old == modulePath {
+			return append(replacements[:i], replacements[i+1:]...)
+		}
+	}
+	return replacements
+}
+
+// rebuildInPlace builds a replacement Caddy binary with the given plugin
+// set and atomically swaps it in for binary, so a failed build never
+// leaves the existing installation half-replaced.
+func rebuildInPlace(ctx context.Context, binary, caddyVer string, plugins []xcaddy.Dependency, replacements []xcaddy.Replace) error {
+	dir := filepath.Dir(binary)
+	tmp, err := os.CreateTemp(dir, filepath.Base(binary)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpName)
+
+	if err := embedBuildInfo(caddyVer, plugins, replacements); err != nil {
+		return fmt.Errorf("embedding build info: %v", err)
+	}
+
+	builder := xcaddy.Builder{
+		CaddyVersion: caddyVer,
+		Plugins:      plugins,
+		Replacements: replacements,
+	}
+	if err := builder.Build(ctx, tmpName); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmpName, 0755); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpName, binary)
+}
+
 func runDev(ctx context.Context, args []string) error {
 	const binOutput = "./caddy"
 
@@ -211,28 +686,93 @@ func runDev(ctx context.Context, args []string) error {
 		return err
 	}
 	defer func() {
-		err = os.Remove(binOutput)
+		err := os.Remove(binOutput)
 		if err != nil && !os.IsNotExist(err) {
 			log.Printf("[ERROR] Deleting temporary binary %s: %v", binOutput, err)
 		}
 	}()
 
+	// if we're cancelled (e.g. by SIGINT) before the child exits on its
+	// own, nudge it to shut down gracefully and escalate if it ignores us,
+	// rather than relying on the signal having also reached the child
+	// directly (it may be in a different process group)
+	childExited := make(chan struct{})
+	defer close(childExited)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stop := gracefullyStop(cmd.Process, shutdownGracePeriod)
+			<-childExited
+			stop()
+		case <-childExited:
+		}
+	}()
+
 	return cmd.Wait()
 }
 
-func trapSignals(ctx context.Context, cancel context.CancelFunc) {
+// trapSignals waits for SIGINT and cancels ctx in response. The returned
+// channel is closed if and only if that happened, so callers can tell a
+// SIGINT-triggered shutdown apart from a normal, successful exit.
+func trapSignals(ctx context.Context, cancel context.CancelFunc) <-chan struct{} {
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
+	interrupted := make(chan struct{})
+
+	go func() {
+		select {
+		case <-sig:
+			log.Printf("[INFO] SIGINT: Shutting down")
+			close(interrupted)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	select {
-	case <-sig:
-		log.Printf("[INFO] SIGINT: Shutting down")
-		cancel()
-	case <-ctx.Done():
+	return interrupted
+}
+
+// sweepBuildEnvTempDirs removes any "buildenv_*" scratch directories left
+// behind under dir by an xcaddy.Builder whose build was cut short, e.g. by
+// a SIGINT that raced the builder's own cleanup. dir should be a temp
+// directory private to this invocation (see main), not the shared
+// os.TempDir(), so this never touches another invocation's build.
+func sweepBuildEnvTempDirs(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
 		return
 	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "buildenv_") {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			log.Printf("[ERROR] Removing leftover build directory %s: %v", entry.Name(), err)
+		}
+	}
+}
+
+// gracefullyStop sends proc an interrupt signal and escalates to Kill if it
+// hasn't exited within grace. The returned stop func must be called once
+// the process is known to have exited, to cancel the pending escalation.
+func gracefullyStop(proc *os.Process, grace time.Duration) (stop func()) {
+	if proc == nil {
+		return func() {}
+	}
+	_ = proc.Signal(os.Interrupt)
+	timer := time.AfterFunc(grace, func() {
+		_ = proc.Kill()
+	})
+	return func() { timer.Stop() }
 }
 
+// splitWith parses a --with argument of the form module[@version][=replace].
+// The version may be a semantic version, or a pseudo-version such as a git
+// commit SHA or branch name (both are passed through to `go get` as-is,
+// which already understands them). If replace is a local filesystem path
+// rather than a module path, it must exist and be a Go module (i.e.
+// contain a go.mod); in that case, a missing version defaults to v0.0.0,
+// since a local replace doesn't need a real version to satisfy `go mod`.
 func splitWith(arg string) (module, version, replace string, err error) {
 	const versionSplit, replaceSplit = "@", "="
 
@@ -256,7 +796,35 @@ func splitWith(arg string) (module, version, replace string, err error) {
 
 	if module == "" {
 		err = fmt.Errorf("module name is required")
+		return
+	}
+
+	if replace != "" && isLocalPath(replace) {
+		info, statErr := os.Stat(replace)
+		if statErr != nil {
+			err = fmt.Errorf("replace path %q does not exist: %w", replace, statErr)
+			return
+		}
+		if !info.IsDir() {
+			err = fmt.Errorf("replace path %q is not a directory", replace)
+			return
+		}
+		if _, statErr := os.Stat(filepath.Join(replace, "go.mod")); statErr != nil {
+			err = fmt.Errorf("replace path %q is not a Go module (no go.mod)", replace)
+			return
+		}
+		if version == "" {
+			version = "v0.0.0"
+		}
 	}
 
 	return
 }
+
+// isLocalPath reports whether s looks like a filesystem path rather than
+// a module import path, i.e. it's the kind of right-hand side of a
+// replace directive that `go mod edit -replace` would require a version
+// for, but a local checkout doesn't actually have one.
+func isLocalPath(s string) bool {
+	return strings.HasPrefix(s, "./") || strings.HasPrefix(s, "../") || filepath.IsAbs(s)
+}
